@@ -1,19 +1,27 @@
 package cliupdater
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/blang/semver"
 	"github.com/kardianos/osext"
+	"github.com/kr/binarydist"
 )
 
 // DefaultCheckInterval is the minimum time between checks to see if the program is updated.
@@ -22,6 +30,34 @@ const checkSuffix = ".check"
 const downloadSuffix = ".download"
 const backupSuffix = ".backup"
 
+// signatureSuffix is appended to the update URL to fetch a detached ed25519 signature of the
+// binary, used when PublicKey is set.
+const signatureSuffix = ".sig"
+
+// sha256Suffix is appended to the update URL to fetch a hex-encoded SHA-256 digest of the
+// binary, used when VerifyChecksum is set.
+const sha256Suffix = ".sha256"
+
+// manifestPath is appended to BaseURL to fetch the JSON version manifest, used when
+// CurrentVersion is set.
+const manifestPath = "/manifest.json"
+
+// listenFDsEnv is set by Restart to tell the restarted process how many of InheritedListeners
+// were passed down, starting at file descriptor listenFDsStart. Modeled on systemd's socket
+// activation protocol.
+const listenFDsEnv = "CLIUPDATER_LISTEN_FDS"
+const listenFDsStart = 3
+
+// downloadStateSuffix is appended to the in-progress download path to record the validators of
+// the partial download, so a later Update() can decide whether it is safe to resume it.
+const downloadStateSuffix = ".state"
+
+// DefaultMaxRetries is the default number of times to retry a failed HTTP request.
+const DefaultMaxRetries = 3
+
+// DefaultRetryBackoff is the default initial delay between retries, doubled after each attempt.
+const DefaultRetryBackoff = 500 * time.Millisecond
+
 func nilLogf(message string, args ...interface{}) {
 }
 
@@ -59,14 +95,57 @@ type Updater struct {
 	// Call the new binary with these arguments to "apply" an update. If it fails, the binary
 	// will not be replaced.
 	ApplyArgs []string
+	// If set, the downloaded binary must be signed: Update fetches the binary's download URL
+	// with ".sig" appended and verifies it as a detached ed25519 signature of the binary before
+	// applying or installing it.
+	PublicKey ed25519.PublicKey
+	// If true, Update fetches the binary's download URL with ".sha256" appended and verifies it
+	// matches the SHA-256 digest of the downloaded binary before applying or installing it. Can
+	// be combined with PublicKey.
+	VerifyChecksum bool
+	// If set, Update first attempts to fetch a bsdiff-format binary patch from the currently
+	// installed binary to the latest version, rather than downloading the whole binary. Falls
+	// back to a full download if no matching patch is available.
+	PatchBaseURL string
+	// If true, Update calls Restart after a successful update instead of returning.
+	RestartAfterUpdate bool
+	// Listeners to pass to the restarted process, e.g. for servers that should not drop
+	// connections across a restart. Only honored on Unix; on Windows, Restart closes them
+	// instead of passing them down.
+	InheritedListeners []net.Listener
+	// HTTP client used for all requests; defaults to http.DefaultClient. Inject a custom client
+	// to add auth, proxying, or to use an httptest client in tests.
+	HTTPClient *http.Client
+	// Maximum number of times to retry a request that fails with a transient network error or a
+	// 5xx response; defaults to DefaultMaxRetries.
+	MaxRetries int
+	// Initial delay between retries, doubled after each attempt; defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+	// If set, MaybeCheckForUpdate fetches a JSON manifest at BaseURL+"/manifest.json" and
+	// determines outdated-ness by comparing CurrentVersion against the highest semver entry
+	// matching Channel, GOOS and GOARCH, rather than comparing the binary's mtime. Update also
+	// downloads from that entry's URL instead of the default BaseURL-OS-Arch convention. Leave
+	// unset to keep the default mtime-based check.
+	CurrentVersion string
+	// Restricts manifest entries to this channel (e.g. "stable", "beta"). Ignored unless
+	// CurrentVersion is set.
+	Channel string
 }
 
 // Metadata contains information about the source binary and the binary on disk.
 type Metadata struct {
-	// The time the source binary was updated.
+	// The time the source binary was updated. Zero in manifest mode (see Updater.CurrentVersion).
 	Updated time.Time
-	// The difference between the update time of the source binary and the binary on disk.
+	// The difference between the update time of the source binary and the binary on disk. In
+	// manifest mode, this is not a meaningful duration: it is merely positive if LatestVersion is
+	// newer than Updater.CurrentVersion, and zero otherwise. Use Outdated() rather than
+	// inspecting Diff directly.
 	Diff time.Duration
+	// The highest version advertised by the manifest matching Channel/GOOS/GOARCH. Only set in
+	// manifest mode (see Updater.CurrentVersion).
+	LatestVersion string
+	// Release notes for LatestVersion, pulled from the manifest. Only set in manifest mode.
+	ReleaseNotes string
 }
 
 // Outdated returns true if the local binary is out of date.
@@ -74,7 +153,9 @@ func (u Metadata) Outdated() bool {
 	return u.Diff > 0
 }
 
-// DaysOld returns the number of days that the local binary is out of date.
+// DaysOld returns the number of days that the local binary is out of date. In manifest mode (see
+// Updater.CurrentVersion) Diff is not a real duration, so DaysOld always returns 0 even when
+// LatestVersion is many releases ahead; check Outdated() and LatestVersion instead in that mode.
 func (u Metadata) DaysOld() int {
 	return int(u.Diff.Hours()/24 + 0.5)
 }
@@ -100,13 +181,81 @@ func (u *Updater) checkValidity() error {
 			return err
 		}
 	}
+	if u.HTTPClient == nil {
+		u.HTTPClient = http.DefaultClient
+	}
+	if u.MaxRetries == 0 {
+		u.MaxRetries = DefaultMaxRetries
+	}
+	if u.MaxRetries < 0 {
+		return errors.New("Updater: MaxRetries must be >= 0")
+	}
+	if u.RetryBackoff == time.Duration(0) {
+		u.RetryBackoff = DefaultRetryBackoff
+	}
+	if u.RetryBackoff <= 0 {
+		return errors.New("Updater: RetryBackoff must be > 0")
+	}
 	return nil
 }
 
+// doRequest executes req, retrying transient network errors and 5xx responses up to
+// u.MaxRetries times with exponential backoff starting at u.RetryBackoff.
+func (u *Updater) doRequest(req *http.Request) (*http.Response, error) {
+	backoff := u.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= u.MaxRetries; attempt++ {
+		if attempt > 0 {
+			u.Logf("retrying %s %s after error: %s", req.Method, req.URL, lastErr.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		resp, err := u.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = errors.New("status not OK: " + resp.Status)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
 func (u *Updater) updateURL() string {
 	return u.BaseURL + "-" + unameOS() + "-" + unameArch()
 }
 
+// checkState is the contents of the ".check" sidecar file: the validators from the last HTTP
+// response, used to make conditional requests so unchanged binaries can be checked with a cheap
+// 304 Not Modified response instead of a full body.
+type checkState struct {
+	LastModified string `json:"lastModified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+// parseContentRangeStart extracts the start offset from a "Content-Range: bytes start-end/total"
+// response header. It returns false if header does not have the expected form.
+func parseContentRangeStart(header string) (int64, bool) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(header, prefix) {
+		return 0, false
+	}
+	dash := strings.IndexByte(header, '-')
+	if dash <= len(prefix) {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(header[len(prefix):dash], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
 // MaybeCheckForUpdate checks for an update if it has been long enough since the last check. It
 // returns the metadata or an error if it executes a check. It returns a zero Metadata value if
 // it does not check for an update.
@@ -120,9 +269,17 @@ func (u *Updater) MaybeCheckForUpdate() (Metadata, error) {
 	checkStampPath := dir + "." + base + checkSuffix
 	u.Logf("reading timestamp from check file: %s ...", checkStampPath)
 	var lastCheckTime time.Time
+	var state checkState
 	fileinfo, err := os.Stat(checkStampPath)
 	if err == nil {
 		lastCheckTime = fileinfo.ModTime()
+		contents, readErr := ioutil.ReadFile(checkStampPath)
+		if readErr != nil {
+			return Metadata{}, readErr
+		}
+		// ignore unmarshal errors: older versions wrote an empty file here, which means we have
+		// no validators, but we've still checked before
+		json.Unmarshal(contents, &state)
 	} else if !os.IsNotExist(err) {
 		// ignore "file does not exist" errors: means we've never checked for an update
 		return Metadata{}, err
@@ -135,6 +292,20 @@ func (u *Updater) MaybeCheckForUpdate() (Metadata, error) {
 		return Metadata{}, nil
 	}
 
+	if u.CurrentVersion != "" {
+		metadata, err := u.checkManifest()
+		if err != nil {
+			return Metadata{}, err
+		}
+		// we completed a check: update our timestamp; the manifest mode has no validators to
+		// persist, so leave the check file empty
+		err = ioutil.WriteFile(checkStampPath, []byte{}, 0600)
+		if err != nil {
+			return Metadata{}, err
+		}
+		return metadata, nil
+	}
+
 	// read the last modified time from the executable
 	u.Logf("checking modified time of executable path: %s ...", u.Path)
 	fileinfo, err = os.Stat(u.Path)
@@ -142,10 +313,21 @@ func (u *Updater) MaybeCheckForUpdate() (Metadata, error) {
 		return Metadata{}, err
 	}
 
-	// read the last modified time from HTTP HEAD
+	// read the last modified time from HTTP HEAD, conditional on the validators from the
+	// previous check so an unchanged binary can be answered with a cheap 304 Not Modified
 	url := u.updateURL()
 	u.Logf("checking modified time of URL: %s ...", url)
-	resp, err := http.Head(url)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if state.LastModified != "" {
+		req.Header.Set("If-Modified-Since", state.LastModified)
+	}
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	resp, err := u.doRequest(req)
 	if err != nil {
 		return Metadata{}, err
 	}
@@ -158,22 +340,110 @@ func (u *Updater) MaybeCheckForUpdate() (Metadata, error) {
 	if err != nil {
 		return Metadata{}, err
 	}
-	if resp.StatusCode != http.StatusOK {
+
+	var modifiedString string
+	if resp.StatusCode == http.StatusNotModified {
+		u.Logf("server reported not modified")
+		modifiedString = state.LastModified
+	} else if resp.StatusCode == http.StatusOK {
+		modifiedString = resp.Header.Get("Last-Modified")
+		state = checkState{LastModified: modifiedString, ETag: resp.Header.Get("ETag")}
+	} else {
 		return Metadata{}, errors.New("status not 200 OK: " + resp.Status)
 	}
-	modifiedString := resp.Header.Get("Last-Modified")
 	httpModified, err := time.Parse(time.RFC1123, modifiedString)
 	if err != nil {
 		return Metadata{}, err
 	}
 
-	// we completed a check: update our timestamp
-	err = ioutil.WriteFile(checkStampPath, []byte{}, 0600)
+	// we completed a check: persist the validators and update our timestamp
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return Metadata{}, err
+	}
+	err = ioutil.WriteFile(checkStampPath, stateJSON, 0600)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return Metadata{Updated: httpModified, Diff: httpModified.Sub(fileinfo.ModTime())}, nil
+}
+
+// manifestEntry describes one buildable artifact in the JSON version manifest fetched from
+// BaseURL+"/manifest.json" when Updater.CurrentVersion is set. URL is where Update downloads the
+// binary from in manifest mode, in place of the default BaseURL-OS-Arch convention; integrity
+// verification still works the normal way (PublicKey/VerifyChecksum, fetched relative to URL).
+type manifestEntry struct {
+	Version      string `json:"version"`
+	Channel      string `json:"channel"`
+	OS           string `json:"os"`
+	Arch         string `json:"arch"`
+	URL          string `json:"url"`
+	ReleaseNotes string `json:"releaseNotes"`
+}
+
+// resolveManifestEntry fetches the JSON manifest and returns the highest semver entry matching
+// u.Channel/GOOS/GOARCH, along with its parsed version.
+func (u *Updater) resolveManifestEntry() (*manifestEntry, semver.Version, error) {
+	manifestURL := u.BaseURL + manifestPath
+	u.Logf("fetching version manifest from %s ...", manifestURL)
+	body, err := u.fetchBody(manifestURL)
+	if err != nil {
+		return nil, semver.Version{}, err
+	}
+	var entries []manifestEntry
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, semver.Version{}, fmt.Errorf("Updater: failed to parse manifest: %s", err.Error())
+	}
+
+	var best *manifestEntry
+	var bestVersion semver.Version
+	for i := range entries {
+		entry := &entries[i]
+		if entry.OS != runtime.GOOS || entry.Arch != runtime.GOARCH {
+			continue
+		}
+		if u.Channel != "" && entry.Channel != u.Channel {
+			continue
+		}
+		version, err := semver.Parse(entry.Version)
+		if err != nil {
+			u.Logf("skipping manifest entry with invalid version %q: %s", entry.Version, err.Error())
+			continue
+		}
+		if best == nil || version.GT(bestVersion) {
+			best = entry
+			bestVersion = version
+		}
+	}
+	if best == nil {
+		return nil, semver.Version{}, fmt.Errorf(
+			"Updater: no manifest entry for channel %q os %q arch %q", u.Channel, runtime.GOOS, runtime.GOARCH)
+	}
+	return best, bestVersion, nil
+}
+
+// checkManifest implements the manifest-based discovery mode: it fetches the JSON manifest,
+// picks the highest semver entry matching u.Channel/GOOS/GOARCH, and reports outdated-ness by
+// comparing that version against u.CurrentVersion.
+func (u *Updater) checkManifest() (Metadata, error) {
+	currentVersion, err := semver.Parse(u.CurrentVersion)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("Updater: invalid CurrentVersion %q: %s", u.CurrentVersion, err.Error())
+	}
+	best, bestVersion, err := u.resolveManifestEntry()
 	if err != nil {
 		return Metadata{}, err
 	}
 
-	return Metadata{httpModified, httpModified.Sub(fileinfo.ModTime())}, nil
+	metadata := Metadata{LatestVersion: best.Version, ReleaseNotes: best.ReleaseNotes}
+	if bestVersion.GT(currentVersion) {
+		// Diff only needs to be positive to mark the binary outdated; its magnitude isn't
+		// meaningful when versions, not timestamps, drive the comparison.
+		metadata.Diff = time.Second
+	}
+	return metadata, nil
 }
 
 // Update downloads the most recent version and replaces the current version.
@@ -186,37 +456,41 @@ func (u *Updater) Update() error {
 	// attempt to open the replacement temporary file
 	dir, base := path.Split(u.Path)
 	updatePath := dir + "." + base + downloadSuffix
-	u.Logf("opening update file %s", updatePath)
-	f, err := os.OpenFile(updatePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0700)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// start the download
 	url := u.updateURL()
-	u.Logf("downloading update from %s", url)
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return errors.New("status not 200 OK: " + resp.Status)
+	if u.CurrentVersion != "" {
+		best, _, err := u.resolveManifestEntry()
+		if err != nil {
+			return err
+		}
+		url = best.URL
 	}
-	// download the file
-	_, err = io.Copy(f, resp.Body)
-	if err != nil {
-		return err
+
+	patched := false
+	if u.PatchBaseURL != "" {
+		var err error
+		patched, err = u.tryPatch(updatePath, url)
+		if err != nil {
+			return err
+		}
 	}
-	err = resp.Body.Close()
-	if err != nil {
-		return err
+
+	if !patched {
+		err = u.downloadFull(updatePath, url)
+		if err != nil {
+			return err
+		}
 	}
-	err = f.Close()
+
+	err = u.verifyDownload(updatePath, url)
 	if err != nil {
+		removeErr := os.Remove(updatePath)
+		if removeErr != nil {
+			u.Logf("failed to remove invalid download %s: %s", updatePath, removeErr.Error())
+		}
+		os.Remove(updatePath + downloadStateSuffix)
 		return err
 	}
+	os.Remove(updatePath + downloadStateSuffix)
 
 	if len(u.ApplyArgs) != 0 {
 		u.Logf("executing new binary with apply flags: %s", strings.Join(u.ApplyArgs, " "))
@@ -246,5 +520,303 @@ func (u *Updater) Update() error {
 		return err
 	}
 	u.Logf("renaming downloaded file %s to final path: %s", updatePath, u.Path)
-	return os.Rename(updatePath, u.Path)
+	err = os.Rename(updatePath, u.Path)
+	if err != nil {
+		return err
+	}
+
+	if u.RestartAfterUpdate {
+		return u.Restart()
+	}
+	return nil
+}
+
+// Restart re-executes u.Path, forwarding argv, environment, stdio, and InheritedListeners; the
+// restarted process should call Listeners() at startup to reclaim InheritedListeners. On Unix,
+// with no InheritedListeners, this uses exec so the PID is preserved; with InheritedListeners it
+// instead spawns u.Path as a child process and exits, since passing listeners down safely
+// requires a real child process (see restartProcess). On Windows, which has no equivalent to
+// exec, this always spawns u.Path as a child process and then exits; listeners are not passed
+// down in that case.
+func (u *Updater) Restart() error {
+	env := os.Environ()
+	if len(u.InheritedListeners) > 0 && runtime.GOOS != "windows" {
+		env = append(env, fmt.Sprintf("%s=%d", listenFDsEnv, len(u.InheritedListeners)))
+	}
+	args := append([]string{u.Path}, os.Args[1:]...)
+	return restartProcess(u.Path, args, env, u.InheritedListeners)
+}
+
+// Listeners reclaims the listeners passed down by a parent process's Restart call. It returns an
+// empty slice if the process was not started by Restart with any InheritedListeners.
+func Listeners() ([]net.Listener, error) {
+	countString := os.Getenv(listenFDsEnv)
+	if countString == "" {
+		return nil, nil
+	}
+	var count int
+	_, err := fmt.Sscanf(countString, "%d", &count)
+	if err != nil {
+		return nil, fmt.Errorf("cliupdater: invalid %s: %s", listenFDsEnv, err.Error())
+	}
+
+	listeners := make([]net.Listener, count)
+	for i := 0; i < count; i++ {
+		fd := uintptr(listenFDsStart + i)
+		f := os.NewFile(fd, fmt.Sprintf("inherited-listener-%d", i))
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("cliupdater: failed to reclaim inherited listener %d: %s", i, err.Error())
+		}
+		f.Close()
+		listeners[i] = l
+	}
+	return listeners, nil
+}
+
+// tryPatch attempts to reconstruct the latest binary at downloadPath by fetching and applying a
+// bsdiff patch from the currently installed binary, rather than downloading it whole. It returns
+// true if a patch was successfully fetched and applied and the result matches the target
+// manifest's SHA-256. It returns false, nil (without error) if no matching patch is available or
+// the result doesn't verify, so callers can fall back to a full download.
+func (u *Updater) tryPatch(downloadPath string, url string) (bool, error) {
+	targetManifest, err := u.fetchBody(url + sha256Suffix)
+	if err != nil {
+		u.Logf("patch: failed to fetch target manifest, falling back to full download: %s", err.Error())
+		return false, nil
+	}
+	fields := strings.Fields(string(targetManifest))
+	if len(fields) == 0 {
+		u.Logf("patch: empty target manifest, falling back to full download")
+		return false, nil
+	}
+	targetHash := strings.ToLower(fields[0])
+
+	oldFile, err := os.Open(u.Path)
+	if err != nil {
+		return false, err
+	}
+	defer oldFile.Close()
+	fromHasher := sha256.New()
+	_, err = io.Copy(fromHasher, oldFile)
+	if err != nil {
+		return false, err
+	}
+	fromHash := hex.EncodeToString(fromHasher.Sum(nil))
+	_, err = oldFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	patchURL := u.PatchBaseURL + "-" + fromHash + "-" + unameOS() + "-" + unameArch() + ".patch"
+	u.Logf("patch: fetching %s", patchURL)
+	req, err := http.NewRequest("GET", patchURL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := u.doRequest(req)
+	if err != nil {
+		u.Logf("patch: failed to fetch patch, falling back to full download: %s", err.Error())
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		u.Logf("patch: no patch available from %s, falling back to full download", fromHash)
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		u.Logf("patch: failed to fetch patch, falling back to full download: status not 200 OK: %s", resp.Status)
+		return false, nil
+	}
+
+	f, err := os.OpenFile(downloadPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0700)
+	if err != nil {
+		return false, err
+	}
+	err = binarydist.Patch(oldFile, f, resp.Body)
+	closeErr := f.Close()
+	if err != nil {
+		u.Logf("patch: failed to apply, falling back to full download: %s", err.Error())
+		return false, nil
+	}
+	if closeErr != nil {
+		return false, closeErr
+	}
+
+	patchedFile, err := os.Open(downloadPath)
+	if err != nil {
+		return false, err
+	}
+	patchedHasher := sha256.New()
+	_, err = io.Copy(patchedHasher, patchedFile)
+	patchedFile.Close()
+	if err != nil {
+		return false, err
+	}
+	patchedHash := hex.EncodeToString(patchedHasher.Sum(nil))
+	if !strings.EqualFold(patchedHash, targetHash) {
+		u.Logf("patch: result checksum mismatch, falling back to full download")
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// verifyDownload checks the signature and/or checksum of the file at downloadPath, fetched from
+// url, according to u.PublicKey and u.VerifyChecksum. It returns nil if no verification was
+// configured.
+func (u *Updater) verifyDownload(downloadPath string, url string) error {
+	if u.PublicKey == nil && !u.VerifyChecksum {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(downloadPath)
+	if err != nil {
+		return err
+	}
+
+	if u.PublicKey != nil {
+		sigURL := url + signatureSuffix
+		u.Logf("fetching signature from %s", sigURL)
+		signature, err := u.fetchBody(sigURL)
+		if err != nil {
+			return fmt.Errorf("Update() failed to fetch signature: %s", err.Error())
+		}
+		if !ed25519.Verify(u.PublicKey, contents, signature) {
+			return errors.New("Update(): signature verification failed")
+		}
+	}
+
+	if u.VerifyChecksum {
+		checksumURL := url + sha256Suffix
+		u.Logf("fetching checksum from %s", checksumURL)
+		checksumBody, err := u.fetchBody(checksumURL)
+		if err != nil {
+			return fmt.Errorf("Update() failed to fetch checksum: %s", err.Error())
+		}
+		fields := strings.Fields(string(checksumBody))
+		if len(fields) == 0 {
+			return errors.New("Update(): empty checksum response")
+		}
+		expected := fields[0]
+		sum := sha256.Sum256(contents)
+		actual := hex.EncodeToString(sum[:])
+		if !strings.EqualFold(expected, actual) {
+			return fmt.Errorf("Update(): checksum mismatch: expected %s actual %s", expected, actual)
+		}
+	}
+
+	return nil
+}
+
+// fetchBody issues an HTTP GET to url and returns the entire response body. It returns an error
+// if the response status is not 200 OK.
+func (u *Updater) fetchBody(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("status not 200 OK: " + resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// downloadFull downloads the full binary at url into downloadPath, resuming a previous partial
+// download if downloadPath already holds bytes whose validators (recorded alongside it) still
+// match the server's current copy.
+func (u *Updater) downloadFull(downloadPath string, url string) error {
+	var priorState checkState
+	var resumeFrom int64
+	if fileinfo, statErr := os.Stat(downloadPath); statErr == nil && fileinfo.Size() > 0 {
+		contents, readErr := ioutil.ReadFile(downloadPath + downloadStateSuffix)
+		if readErr == nil {
+			json.Unmarshal(contents, &priorState)
+		}
+		if priorState.ETag != "" || priorState.LastModified != "" {
+			resumeFrom = fileinfo.Size()
+		}
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if resumeFrom > 0 {
+		u.Logf("resuming download of %s from byte %d", url, resumeFrom)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+		if priorState.ETag != "" {
+			req.Header.Set("If-Range", priorState.ETag)
+		} else {
+			req.Header.Set("If-Range", priorState.LastModified)
+		}
+	}
+
+	u.Logf("downloading update from %s", url)
+	resp, err := u.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	resuming := resumeFrom > 0 && resp.StatusCode == http.StatusPartialContent
+	if resuming {
+		start, ok := parseContentRangeStart(resp.Header.Get("Content-Range"))
+		if !ok || start != resumeFrom {
+			u.Logf("resume: unexpected Content-Range %q for requested offset %d, restarting download from scratch",
+				resp.Header.Get("Content-Range"), resumeFrom)
+			resp.Body.Close()
+			if err := os.Remove(downloadPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Remove(downloadPath + downloadStateSuffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return u.downloadFull(downloadPath, url)
+		}
+	}
+	if !resuming && resp.StatusCode != http.StatusOK {
+		return errors.New("status not 200 OK: " + resp.Status)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if resuming {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	u.Logf("opening update file %s", downloadPath)
+	f, err := os.OpenFile(downloadPath, flags, 0700)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !resuming {
+		newState := checkState{LastModified: resp.Header.Get("Last-Modified"), ETag: resp.Header.Get("ETag")}
+		stateJSON, err := json.Marshal(newState)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(downloadPath+downloadStateSuffix, stateJSON, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
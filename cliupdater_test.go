@@ -1,6 +1,13 @@
 package cliupdater
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -10,18 +17,31 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kr/binarydist"
+
 	"testing"
 )
 
 const defaultUpdateBinary = "#!/bin/sh\necho hello args $@\n"
 
 type fixture struct {
-	tempdir  string
-	modified time.Time
-	requests int
-	server   *httptest.Server
-	updater  Updater
-	binary   string
+	tempdir         string
+	modified        time.Time
+	requests        int
+	server          *httptest.Server
+	updater         Updater
+	binary          string
+	privateKey      ed25519.PrivateKey
+	badSignature    bool
+	badChecksum     bool
+	patch           []byte
+	patchFromHash   string
+	requestPaths    []string
+	etag            string
+	failures        int
+	ranges          []string
+	manifest        string
+	badContentRange bool
 }
 
 func newFixture() (*fixture, error) {
@@ -35,7 +55,13 @@ func newFixture() (*fixture, error) {
 		return nil, err
 	}
 
-	f := &fixture{tempdir, modified, 0, nil, Updater{}, defaultUpdateBinary}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, err
+	}
+
+	f := &fixture{tempdir, modified, 0, nil, Updater{}, defaultUpdateBinary, privateKey, false, false, nil, "", nil, "", 0, nil, "", false}
 	f.server = httptest.NewServer(f)
 
 	f.updater.BaseURL = f.server.URL + "/somebinary"
@@ -55,14 +81,79 @@ func (f *fixture) close() {
 	os.RemoveAll(f.tempdir)
 }
 
+func (f *fixture) publicKey() ed25519.PublicKey {
+	return f.privateKey.Public().(ed25519.PublicKey)
+}
+
 func (f *fixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	f.requests++
+	f.requestPaths = append(f.requestPaths, r.URL.Path)
 	if r.Method == "HEAD" {
+		if f.etag != "" && r.Header.Get("If-None-Match") == f.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" &&
+			ifModifiedSince == f.modified.Format(time.RFC1123) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		w.Header().Set("Last-Modified", f.modified.Format(time.RFC1123))
-	} else if r.Method == "GET" {
-		w.Write([]byte(f.binary))
-	} else {
+		if f.etag != "" {
+			w.Header().Set("ETag", f.etag)
+		}
+		return
+	}
+	if r.Method != "GET" {
 		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, manifestPath) {
+		w.Write([]byte(f.manifest))
+	} else if strings.HasSuffix(r.URL.Path, signatureSuffix) {
+		signature := ed25519.Sign(f.privateKey, []byte(f.binary))
+		if f.badSignature {
+			signature[0]++
+		}
+		w.Write(signature)
+	} else if strings.HasSuffix(r.URL.Path, sha256Suffix) {
+		sum := sha256.Sum256([]byte(f.binary))
+		digest := hex.EncodeToString(sum[:])
+		if f.badChecksum {
+			digest = strings.Repeat("0", len(digest))
+		}
+		w.Write([]byte(digest))
+	} else if strings.HasSuffix(r.URL.Path, ".patch") {
+		if f.patch == nil || !strings.Contains(r.URL.Path, f.patchFromHash) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(f.patch)
+	} else {
+		if f.failures > 0 {
+			f.failures--
+			http.Error(w, "simulated failure", http.StatusInternalServerError)
+			return
+		}
+
+		rangeHeader := r.Header.Get("Range")
+		f.ranges = append(f.ranges, rangeHeader)
+		if rangeHeader != "" && r.Header.Get("If-Range") == f.etag {
+			var start int
+			fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+			contentRangeStart := start
+			if f.badContentRange {
+				contentRangeStart = 0
+			}
+			w.Header().Set("ETag", f.etag)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", contentRangeStart, len(f.binary)-1, len(f.binary)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(f.binary)[start:])
+			return
+		}
+		w.Header().Set("ETag", f.etag)
+		w.Write([]byte(f.binary))
 	}
 }
 
@@ -131,6 +222,140 @@ func TestMaybeCheckForUpdate(t *testing.T) {
 	}
 }
 
+func TestMaybeCheckForUpdateConditional(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.etag = `"abc123"`
+
+	// first check: nothing to be conditional on, server replies 200
+	metadata, err := f.updater.MaybeCheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Outdated() {
+		t.Error("expected not outdated:", metadata)
+	}
+
+	// back date the check timestamp so the next call actually checks again
+	err = os.Chtimes(f.tempdir+"/.somebinary"+checkSuffix, f.modified, f.modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = f.updater.MaybeCheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Outdated() {
+		t.Error("expected not outdated:", metadata)
+	}
+
+	contents, err := ioutil.ReadFile(f.tempdir + "/.somebinary" + checkSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state checkState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ETag != f.etag {
+		t.Error("expected check file to persist the ETag:", state)
+	}
+}
+
+func TestMaybeCheckForUpdateManifest(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.manifest = fmt.Sprintf(`[
+		{"version":"1.4.2","channel":"stable","os":"%s","arch":"%s","url":"https://example.com/v1.4.2","releaseNotes":"fixed bugs"},
+		{"version":"1.5.0","channel":"beta","os":"%s","arch":"%s","url":"https://example.com/v1.5.0"},
+		{"version":"1.3.0","channel":"stable","os":"other","arch":"other","url":"https://example.com/wrongplatform"}
+	]`, runtime.GOOS, runtime.GOARCH, runtime.GOOS, runtime.GOARCH)
+
+	f.updater.CurrentVersion = "1.4.2"
+	f.updater.Channel = "stable"
+	metadata, err := f.updater.MaybeCheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Outdated() {
+		t.Error("expected not outdated at the latest stable version:", metadata)
+	}
+	if metadata.LatestVersion != "1.4.2" {
+		t.Error("unexpected LatestVersion:", metadata.LatestVersion)
+	}
+	if metadata.ReleaseNotes != "fixed bugs" {
+		t.Error("unexpected ReleaseNotes:", metadata.ReleaseNotes)
+	}
+}
+
+func TestMaybeCheckForUpdateManifestOutdated(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.manifest = fmt.Sprintf(`[{"version":"2.0.0","channel":"stable","os":"%s","arch":"%s","url":"https://example.com/v2"}]`,
+		runtime.GOOS, runtime.GOARCH)
+
+	f.updater.CurrentVersion = "1.0.0"
+	f.updater.Channel = "stable"
+	metadata, err := f.updater.MaybeCheckForUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.Outdated() {
+		t.Error("expected outdated:", metadata)
+	}
+	if metadata.LatestVersion != "2.0.0" {
+		t.Error("unexpected LatestVersion:", metadata.LatestVersion)
+	}
+}
+
+func TestUpdateUsesManifestURL(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.manifest = fmt.Sprintf(`[{"version":"2.0.0","channel":"stable","os":"%s","arch":"%s","url":"%s/custom-path"}]`,
+		runtime.GOOS, runtime.GOARCH, f.server.URL)
+	f.updater.CurrentVersion = "1.0.0"
+	f.updater.Channel = "stable"
+
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+
+	found := false
+	for _, p := range f.requestPaths {
+		if strings.HasSuffix(p, "/custom-path") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected Update to fetch from the manifest entry's URL:", f.requestPaths)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	f, err := newFixture()
 	if err != nil {
@@ -197,6 +422,283 @@ echo "$@" > $DIR/update-args.txt`
 
 }
 
+func TestUpdateWithPublicKey(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.updater.PublicKey = f.publicKey()
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+}
+
+func TestUpdateWithPublicKeyBadSignature(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.updater.PublicKey = f.publicKey()
+	f.badSignature = true
+	err = f.updater.Update()
+	if err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Error("should not have updated binary")
+	}
+	if _, err := os.Stat(f.tempdir + "/.somebinary" + downloadSuffix); !os.IsNotExist(err) {
+		t.Error("download file should have been removed", err)
+	}
+}
+
+func TestUpdateWithVerifyChecksum(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.updater.VerifyChecksum = true
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+}
+
+func TestUpdateWithVerifyChecksumMismatch(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.updater.VerifyChecksum = true
+	f.badChecksum = true
+	err = f.updater.Update()
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Error("should not have updated binary")
+	}
+}
+
+func TestUpdateRetriesOnServerError(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.failures = 2
+	f.updater.RetryBackoff = time.Millisecond
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+}
+
+func TestUpdateRetriesExhausted(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.failures = 10
+	f.updater.MaxRetries = 1
+	f.updater.RetryBackoff = time.Millisecond
+	err = f.updater.Update()
+	if err == nil {
+		t.Fatal("expected error: server should still be failing")
+	}
+}
+
+func TestUpdateResumesPartialDownload(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.etag = `"abc123"`
+	partial := defaultUpdateBinary[:4]
+	downloadPath := f.tempdir + "/.somebinary" + downloadSuffix
+	err = ioutil.WriteFile(downloadPath, []byte(partial), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(downloadPath+downloadStateSuffix, []byte(`{"etag":"\"abc123\""}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+
+	found := false
+	for _, r := range f.ranges {
+		if r == "bytes=4-" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected a Range request resuming from byte 4:", f.ranges)
+	}
+}
+
+func TestUpdateResumeRejectsMismatchedContentRange(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	f.etag = `"abc123"`
+	f.badContentRange = true
+	partial := defaultUpdateBinary[:4]
+	downloadPath := f.tempdir + "/.somebinary" + downloadSuffix
+	err = ioutil.WriteFile(downloadPath, []byte(partial), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(downloadPath+downloadStateSuffix, []byte(`{"etag":"\"abc123\""}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file; resume should have been rejected and restarted:", string(out))
+	}
+}
+
+func TestUpdateWithPatch(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	oldBinary := "#!/bin/sh\necho old version\n"
+	err = ioutil.WriteFile(f.updater.Path, []byte(oldBinary), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSum := sha256.Sum256([]byte(oldBinary))
+	f.patchFromHash = hex.EncodeToString(oldSum[:])
+
+	var patch bytes.Buffer
+	err = binarydist.Diff(strings.NewReader(oldBinary), strings.NewReader(f.binary), &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.patch = patch.Bytes()
+
+	f.updater.PatchBaseURL = f.server.URL + "/somebinary-patch"
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+
+	for _, r := range f.requestPaths {
+		if strings.HasSuffix(r, "/somebinary-"+unameOS()+"-"+unameArch()) {
+			t.Error("should not have fetched the full binary when a patch applied:", r)
+		}
+	}
+}
+
+func TestUpdateWithPatchFallback(t *testing.T) {
+	f, err := newFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+
+	// no patch is registered on the server, so this should fall back to a full download
+	f.updater.PatchBaseURL = f.server.URL + "/somebinary-patch"
+	err = f.updater.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(f.updater.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != defaultUpdateBinary {
+		t.Error("unexpected contents of updated file:", string(out))
+	}
+}
+
+func TestListenersNotInherited(t *testing.T) {
+	os.Unsetenv(listenFDsEnv)
+	listeners, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 0 {
+		t.Error("expected no inherited listeners:", listeners)
+	}
+}
+
 func TestGOOSToUname(t *testing.T) {
 	tests := []struct {
 		unameOS string
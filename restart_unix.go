@@ -0,0 +1,57 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cliupdater
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// restartProcess restarts path. With no listeners to pass down, it re-execs path in place of the
+// current process via syscall.Exec, preserving the PID.
+//
+// With listeners, it instead spawns path as a child process with the listeners attached via
+// os/exec's ExtraFiles (which places them at file descriptors starting at listenFDsStart, so the
+// restarted process can reclaim them with Listeners()), then exits. ExtraFiles works by dup2'ing
+// each file into the forked child's fd table after fork but before exec, so unlike dup2'ing the
+// listeners directly into THIS process's fd table before calling syscall.Exec, it can never
+// disturb this (possibly still-running, if something below fails) process's own listeners or the
+// Go runtime's netpoller bookkeeping for them.
+func restartProcess(path string, args []string, env []string, listeners []net.Listener) error {
+	if len(listeners) == 0 {
+		return syscall.Exec(path, args, env)
+	}
+
+	files := make([]*os.File, len(listeners))
+	for i, l := range listeners {
+		lf, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("cliupdater: listener %d of type %T cannot be passed across exec", i, l)
+		}
+		f, err := lf.File()
+		if err != nil {
+			return fmt.Errorf("cliupdater: failed to get file for listener %d: %s", i, err.Error())
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("cliupdater: failed to start restarted process: %s", err.Error())
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,257 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cliupdater
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// restartHelperEnv, when set in the environment, tells this test binary to act as a restart
+// helper subprocess instead of running the normal test suite: see TestRestartProcessExecsTarget.
+const restartHelperEnv = "CLIUPDATER_RESTART_HELPER_TARGET"
+
+// reclaimChildEnv and reclaimParentPortFileEnv drive the two ends of
+// TestListenersRoundTripThroughRestart's helper chain: a "parent" subprocess opens a listener and
+// calls Restart() to hand it down to a "child" subprocess, which reclaims it with Listeners().
+const reclaimChildEnv = "CLIUPDATER_RECLAIM_CHILD"
+const reclaimParentPortFileEnv = "CLIUPDATER_RECLAIM_PARENT_PORTFILE"
+
+func TestMain(m *testing.M) {
+	if target := os.Getenv(restartHelperEnv); target != "" {
+		runRestartHelper(target)
+		// Only reached if restartProcess returned an error instead of starting target.
+		os.Exit(3)
+	}
+	// Checked before reclaimParentPortFileEnv: the child inherits the parent's environment,
+	// portfile var included, so the child marker must take priority to break the tie.
+	if os.Getenv(reclaimChildEnv) != "" {
+		runReclaimChild()
+		os.Exit(0)
+	}
+	if portFile := os.Getenv(reclaimParentPortFileEnv); portFile != "" {
+		runReclaimParent(portFile)
+		os.Exit(3)
+	}
+	os.Exit(m.Run())
+}
+
+// runRestartHelper opens a listener and calls restartProcess to start target as a child process,
+// passing the listener down. If restartProcess succeeds this process exits and runRestartHelper
+// never returns.
+func runRestartHelper(target string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "helper: failed to listen:", err.Error())
+		os.Exit(2)
+	}
+	err = restartProcess(target, []string{target}, os.Environ(), []net.Listener{l})
+	fmt.Fprintln(os.Stderr, "helper: restartProcess returned an error:", err.Error())
+}
+
+// runReclaimParent opens a listener, writes its address to portFile so the test can dial it, then
+// calls Updater.Restart to hand the listener down to a child instance of this same test binary
+// (marked via reclaimChildEnv). If Restart succeeds this process exits and never returns.
+func runReclaimParent(portFile string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-parent: failed to listen:", err.Error())
+		os.Exit(2)
+	}
+	if err := ioutil.WriteFile(portFile, []byte(l.Addr().String()), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-parent: failed to write port file:", err.Error())
+		os.Exit(2)
+	}
+
+	if err := os.Setenv(reclaimChildEnv, "1"); err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-parent: failed to set child env:", err.Error())
+		os.Exit(2)
+	}
+	u := &Updater{Path: os.Args[0], InheritedListeners: []net.Listener{l}}
+	err = u.Restart()
+	fmt.Fprintln(os.Stderr, "reclaim-parent: Restart returned an error:", err.Error())
+}
+
+// runReclaimChild reclaims the listener passed down by runReclaimParent via Listeners(), accepts
+// one connection, and confirms it received the expected payload -- proving listenFDsEnv and
+// listenFDsStart round-trip correctly through a real restarted process.
+func runReclaimChild() {
+	listeners, err := Listeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-child: Listeners() failed:", err.Error())
+		os.Exit(2)
+	}
+	if len(listeners) != 1 {
+		fmt.Fprintln(os.Stderr, "reclaim-child: expected exactly one inherited listener, got", len(listeners))
+		os.Exit(2)
+	}
+
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-child: Accept failed:", err.Error())
+		os.Exit(2)
+	}
+	defer conn.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		fmt.Fprintln(os.Stderr, "reclaim-child: read failed:", err.Error())
+		os.Exit(2)
+	}
+	if string(buf) != "ping" {
+		fmt.Fprintln(os.Stderr, "reclaim-child: unexpected payload:", string(buf))
+		os.Exit(2)
+	}
+	fmt.Println("reclaimed-ok")
+}
+
+// TestRestartProcessExecsTarget runs this test binary as a subprocess in "helper" mode, which
+// calls restartProcess to spawn a small shell script while passing down a listener. It confirms
+// the spawn actually happened by checking the script's output, exercising the real
+// ExtraFiles-based spawn path rather than just restartProcess's bookkeeping.
+func TestRestartProcessExecsTarget(t *testing.T) {
+	script, err := ioutil.TempFile("", "cliupdater_restart_target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	if _, err := script.WriteString("#!/bin/sh\necho restarted-ok\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := script.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(script.Name(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), restartHelperEnv+"="+script.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process failed: %s\noutput:\n%s", err.Error(), out)
+	}
+	if string(out) != "restarted-ok\n" {
+		t.Errorf("expected the helper process to have started the target script; got output %q", out)
+	}
+}
+
+// TestListenersRoundTripThroughRestart exercises the full consumer-facing contract end to end: a
+// "parent" subprocess calls Updater.Restart with InheritedListeners, and a "child" subprocess
+// (the restarted process) calls the public Listeners() function and accepts a connection on the
+// reclaimed listener, proving listenFDsEnv/listenFDsStart round-trip through a real child process.
+func TestListenersRoundTripThroughRestart(t *testing.T) {
+	portFile, err := ioutil.TempFile("", "cliupdater_reclaim_port")
+	if err != nil {
+		t.Fatal(err)
+	}
+	portFile.Close()
+	defer os.Remove(portFile.Name())
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), reclaimParentPortFileEnv+"="+portFile.Name())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var addr string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		contents, readErr := ioutil.ReadFile(portFile.Name())
+		if readErr == nil && len(contents) > 0 {
+			addr = string(contents)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == "" {
+		t.Fatal("timed out waiting for the reclaim-parent helper to report its listener address")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("failed to dial the restarted process's reclaimed listener:", err.Error())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("helper process failed: %s\nstderr:\n%s", err.Error(), stderr.String())
+	}
+	if string(out) != "reclaimed-ok\n" {
+		t.Errorf("expected the restarted child to report success; got stdout %q stderr %q", out, stderr.String())
+	}
+}
+
+// TestRestartProcessLeavesListenersUsableOnBadListener confirms that when restartProcess fails
+// because one of several listeners can't be duplicated across exec, a working listener passed
+// alongside it remains fully functional afterwards: this process's own fd table must never be
+// touched before every listener is confirmed.
+func TestRestartProcessLeavesListenersUsableOnBadListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	err = restartProcess("/nonexistent/cliupdater-test-target", nil, nil, []net.Listener{l, &fileLessListener{}})
+	if err == nil {
+		t.Fatal("expected an error because one listener cannot be duplicated across exec")
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("listener should still be usable after restartProcess returned an error:", err.Error())
+	}
+	conn.Close()
+}
+
+// TestRestartProcessLeavesListenersUsableOnStartFailure confirms that when every listener is
+// valid but the restarted binary itself can't be started (e.g. the freshly-renamed path doesn't
+// exist), this process's listener remains fully functional: restartProcess must not touch this
+// process's own fd table as part of attempting the spawn.
+func TestRestartProcessLeavesListenersUsableOnStartFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	err = restartProcess("/nonexistent/cliupdater-test-target", []string{"/nonexistent/cliupdater-test-target"}, nil, []net.Listener{l})
+	if err == nil {
+		t.Fatal("expected an error because the restarted binary does not exist")
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("listener should still be usable after restartProcess returned an error:", err.Error())
+	}
+	conn.Close()
+}
+
+// fileLessListener is a net.Listener that does not implement File(), used to force
+// restartProcess's error path.
+type fileLessListener struct{}
+
+func (fileLessListener) Accept() (net.Conn, error) { return nil, fmt.Errorf("not implemented") }
+func (fileLessListener) Close() error              { return nil }
+func (fileLessListener) Addr() net.Addr            { return nil }
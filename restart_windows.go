@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package cliupdater
+
+import (
+	"net"
+	"os"
+	"os/exec"
+)
+
+// restartProcess spawns path as a child process and exits; Windows has no equivalent to exec that
+// preserves the PID. listeners are not inherited: Windows file descriptors are not valid across
+// an ordinary process spawn, so any InheritedListeners are closed without being passed down.
+func restartProcess(path string, args []string, env []string, listeners []net.Listener) error {
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}